@@ -18,10 +18,21 @@ package iptables
 
 import (
 	"fmt"
+	"strings"
 
+	utilexec "k8s.io/utils/exec"
 	netutils "k8s.io/utils/net"
 )
 
+// IPFamily identifies a single IP address family, used to key the per-family results
+// returned by the dual-stack detector constructors in this package.
+type IPFamily string
+
+const (
+	IPv4 IPFamily = "ipv4"
+	IPv6 IPFamily = "ipv6"
+)
+
 // LocalTrafficDetector in a interface to take action (jump) based on whether traffic originated locally
 // at the node or not
 type LocalTrafficDetector interface {
@@ -116,6 +127,174 @@ func (d *detectLocalByCIDR) IfNotLocalNFT() []string {
 	return d.ifNotLocalNFT
 }
 
+// splitCIDRsByFamily splits a flat list of CIDRs into per-family buckets, so that callers
+// who receive a single combined `--cluster-cidrs`-style flag can feed it straight into
+// NewDetectLocalByCIDRsDualStack (or validate a single family for NewDetectLocalByCIDRs).
+func splitCIDRsByFamily(cidrs []string) (map[IPFamily][]string, error) {
+	byFamily := make(map[IPFamily][]string)
+	for _, cidr := range cidrs {
+		_, parsed, err := netutils.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return nil, err
+		}
+		family := IPv4
+		if netutils.IsIPv6CIDR(parsed) {
+			family = IPv6
+		}
+		byFamily[family] = append(byFamily[family], cidr)
+	}
+	return byFamily, nil
+}
+
+type detectLocalByCIDRs struct {
+	family IPFamily
+	cidrs  []string
+
+	setName    string
+	nftSetName string
+
+	ifLocal       []string
+	ifNotLocal    []string
+	ifLocalNFT    []string
+	ifNotLocalNFT []string
+}
+
+// NewDetectLocalByCIDRs implements the LocalTrafficDetector interface using a list of CIDRs
+// that all belong to the same IP family. This is the multi-CIDR counterpart of
+// NewDetectLocalByCIDR, for clusters whose pod CIDRs are fragmented across multiple ranges
+// within a single family (for example, NodeCIDRs detect-local mode on a cluster where nodes
+// were allocated pod CIDRs out of more than one range). Use NewDetectLocalByCIDRsDualStack
+// if cidrs may span both families.
+func NewDetectLocalByCIDRs(cidrs []string) (LocalTrafficDetector, error) {
+	byFamily, err := splitCIDRsByFamily(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(byFamily) > 1 {
+		return nil, fmt.Errorf("cidrs contains both IPv4 and IPv6 CIDRs; use NewDetectLocalByCIDRsDualStack for dual-stack clusters")
+	}
+	for family, familyCIDRs := range byFamily {
+		return newDetectLocalByCIDRsForFamily(family, familyCIDRs)
+	}
+	return nil, fmt.Errorf("no CIDRs provided")
+}
+
+// NewDetectLocalByCIDRsDualStack splits cidrs by IP family (see splitCIDRsByFamily) and
+// returns one LocalTrafficDetector per family present, so dual-stack kube-proxy no longer
+// has to construct two detectors by hand and re-implement the family split itself.
+func NewDetectLocalByCIDRsDualStack(cidrs []string) (map[IPFamily]LocalTrafficDetector, error) {
+	byFamily, err := splitCIDRsByFamily(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	detectors := make(map[IPFamily]LocalTrafficDetector, len(byFamily))
+	for family, familyCIDRs := range byFamily {
+		d, err := newDetectLocalByCIDRsForFamily(family, familyCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		detectors[family] = d
+	}
+	return detectors, nil
+}
+
+func newDetectLocalByCIDRsForFamily(family IPFamily, cidrs []string) (LocalTrafficDetector, error) {
+	nftFamily := "ip"
+	if family == IPv6 {
+		nftFamily = "ip6"
+	}
+
+	setName := "KUBE-LOCAL-CIDRS-" + strings.ToUpper(string(family))
+	nftSetName := "local-cidrs-" + string(family)
+
+	return &detectLocalByCIDRs{
+		family:        family,
+		cidrs:         cidrs,
+		setName:       setName,
+		nftSetName:    nftSetName,
+		ifLocal:       []string{"-m", "set", "--match-set", setName, "src"},
+		ifNotLocal:    []string{"-m", "set", "!", "--match-set", setName, "src"},
+		ifLocalNFT:    []string{nftFamily, "saddr", "@" + nftSetName},
+		ifNotLocalNFT: []string{nftFamily, "saddr", "!=", "@" + nftSetName},
+	}, nil
+}
+
+func (d *detectLocalByCIDRs) IsImplemented() bool {
+	return true
+}
+
+func (d *detectLocalByCIDRs) IfLocal() []string {
+	return d.ifLocal
+}
+
+func (d *detectLocalByCIDRs) IfNotLocal() []string {
+	return d.ifNotLocal
+}
+
+func (d *detectLocalByCIDRs) IfLocalNFT() []string {
+	return d.ifLocalNFT
+}
+
+func (d *detectLocalByCIDRs) IfNotLocalNFT() []string {
+	return d.ifNotLocalNFT
+}
+
+// SetName returns the name of the ipset that IfLocal/IfNotLocal reference via
+// `-m set --match-set`. The caller is responsible for creating this set (family hash:net)
+// and loading CIDRs() into it before the detector's rules are installed.
+func (d *detectLocalByCIDRs) SetName() string {
+	return d.setName
+}
+
+// NFTSetName returns the name of the named nftables set that IfLocalNFT/IfNotLocalNFT
+// reference. The caller is responsible for creating this set (matching Family()) and
+// loading CIDRs() into it before the detector's rules are installed.
+func (d *detectLocalByCIDRs) NFTSetName() string {
+	return d.nftSetName
+}
+
+// CIDRs returns the CIDRs that back this detector, for materializing the ipset/nft set
+// named by SetName/NFTSetName.
+func (d *detectLocalByCIDRs) CIDRs() []string {
+	return d.cidrs
+}
+
+// Family returns the IP family this detector was constructed for.
+func (d *detectLocalByCIDRs) Family() IPFamily {
+	return d.family
+}
+
+// IPSetEnsurer is the minimal ipset/nft-set interface a SetInstallingLocalTrafficDetector
+// needs in order to materialize the named set its rules reference.
+type IPSetEnsurer interface {
+	// EnsureSet creates (or updates the membership of) the named hash:net set for family,
+	// containing members.
+	EnsureSet(name string, family IPFamily, members []string) error
+}
+
+// SetInstallingLocalTrafficDetector is implemented by detectors whose IfLocal/IfNotLocal
+// results reference a named ipset/nft set that must exist, and be populated, before those
+// rules are installed. Callers should type-assert for this interface and call EnsureSet
+// once during sync, before wiring the detector's rules into their own chains.
+type SetInstallingLocalTrafficDetector interface {
+	LocalTrafficDetector
+
+	// EnsureSet materializes whatever named set(s) this detector's rules depend on.
+	EnsureSet(ensurer IPSetEnsurer) error
+}
+
+// EnsureSet creates (or refreshes) the ipset named by SetName and the nft set named by
+// NFTSetName, both populated with CIDRs(). A caller that installs this detector's iptables
+// or nft rules without calling EnsureSet first will see iptables-restore/nft errors, since
+// IfLocal/IfNotLocal/IfLocalNFT/IfNotLocalNFT all reference sets by name rather than
+// embedding the CIDRs directly.
+func (d *detectLocalByCIDRs) EnsureSet(ensurer IPSetEnsurer) error {
+	if err := ensurer.EnsureSet(d.setName, d.family, d.cidrs); err != nil {
+		return err
+	}
+	return ensurer.EnsureSet(d.nftSetName, d.family, d.cidrs)
+}
+
 type detectLocalByBridgeInterface struct {
 	ifLocal       []string
 	ifNotLocal    []string
@@ -198,3 +377,330 @@ func (d *detectLocalByInterfaceNamePrefix) IfLocalNFT() []string {
 func (d *detectLocalByInterfaceNamePrefix) IfNotLocalNFT() []string {
 	return d.ifNotLocalNFT
 }
+
+// probeIPTablesMatchSupported shells out to check that the running iptables binary was
+// built with support for the named match extension, so detectors that depend on it can
+// fail fast at construction time instead of producing rules that iptables-restore rejects.
+func probeIPTablesMatchSupported(execer utilexec.Interface, match string) error {
+	out, err := execer.Command("iptables", "-m", match, "-h").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables does not support the %q match needed for this detector: %v (%s)", match, err, out)
+	}
+	return nil
+}
+
+// probeNFTRuleset is a throwaway ruleset that only exercises the `fib` expression, so
+// probeNFTFibSupported's result depends on nft's own capabilities rather than on whatever
+// tables and chains happen to already exist on the host.
+const probeNFTRuleset = `table ip kube-proxy-probe {
+	chain probe {
+		fib saddr type local
+	}
+}
+`
+
+// probeNFTFibSupported does a dry-run check that the loaded nft binary understands the
+// `fib` expression, so NewDetectLocalByKernelRouting can fail fast and let the caller fall
+// back to NoOp on hosts with an nftables build that lacks it. It validates a self-contained
+// ruleset (defining its own throwaway table and chain) rather than adding a rule to a
+// pre-existing chain, so the check doesn't depend on the host already having one.
+func probeNFTFibSupported(execer utilexec.Interface) error {
+	cmd := execer.Command("nft", "-c", "-f", "-")
+	cmd.SetStdin(strings.NewReader(probeNFTRuleset))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft does not support the \"fib\" expression needed for this detector: %v (%s)", err, out)
+	}
+	return nil
+}
+
+// Backend identifies which ruleset backend a caller's proxier uses, so constructors that
+// need to probe for kernel/binary support only probe the backend actually in use.
+type Backend string
+
+const (
+	IPTablesBackend Backend = "iptables"
+	NFTablesBackend Backend = "nftables"
+)
+
+type detectLocalByKernelRouting struct {
+	ifLocal       []string
+	ifNotLocal    []string
+	ifLocalNFT    []string
+	ifNotLocalNFT []string
+}
+
+// NewDetectLocalByKernelRouting implements the LocalTrafficDetector interface by asking the
+// kernel's routing table whether a source address is local, rather than relying on a
+// statically configured CIDR or bridge interface. This works on clusters where pod CIDRs
+// aren't known at kube-proxy start (for example CNIs that allocate per-node out of
+// arbitrary pools, or IPv6 prefix delegation) and so can't use NewDetectLocalByCIDR(s) or
+// NewDetectLocalByBridgeInterface. It probes execer at construction time to confirm that the
+// binary for backend actually supports the required match, returning an error so the caller
+// can fall back to NewNoOpLocalDetector if it doesn't. Only backend is probed: an
+// iptables-only proxier shouldn't fail construction for lack of nft, and vice versa.
+func NewDetectLocalByKernelRouting(execer utilexec.Interface, backend Backend) (LocalTrafficDetector, error) {
+	switch backend {
+	case IPTablesBackend:
+		if err := probeIPTablesMatchSupported(execer, "addrtype"); err != nil {
+			return nil, err
+		}
+	case NFTablesBackend:
+		if err := probeNFTFibSupported(execer); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+
+	return &detectLocalByKernelRouting{
+		ifLocal:       []string{"-m", "addrtype", "--src-type", "LOCAL"},
+		ifNotLocal:    []string{"-m", "addrtype", "!", "--src-type", "LOCAL"},
+		ifLocalNFT:    []string{"fib", "saddr", "type", "local"},
+		ifNotLocalNFT: []string{"fib", "saddr", "type", "!=", "local"},
+	}, nil
+}
+
+func (d *detectLocalByKernelRouting) IsImplemented() bool {
+	return true
+}
+
+func (d *detectLocalByKernelRouting) IfLocal() []string {
+	return d.ifLocal
+}
+
+func (d *detectLocalByKernelRouting) IfNotLocal() []string {
+	return d.ifNotLocal
+}
+
+func (d *detectLocalByKernelRouting) IfLocalNFT() []string {
+	return d.ifLocalNFT
+}
+
+func (d *detectLocalByKernelRouting) IfNotLocalNFT() []string {
+	return d.ifNotLocalNFT
+}
+
+// RulePosition tells an IPTablesEnsurer where in a chain a rule should be ensured, matching
+// the Prepend/Append vocabulary used by this package's callers' iptables wrappers.
+type RulePosition string
+
+const (
+	Prepend RulePosition = "prepend"
+	Append  RulePosition = "append"
+)
+
+// IPTablesEnsurer is the subset of an iptables interface a ChainInstallingLocalTrafficDetector
+// needs in order to install its own helper chain and rules; it lets this package describe
+// what it needs from the caller's iptables wrapper without importing it directly.
+type IPTablesEnsurer interface {
+	EnsureChain(table, chain string) (bool, error)
+	EnsureRule(position RulePosition, table, chain string, args ...string) (bool, error)
+}
+
+// ChainInstallingLocalTrafficDetector is implemented by LocalTrafficDetector strategies that
+// depend on supporting iptables chains and rules existing before their IfLocal/IfNotLocal
+// results are usable. Proxiers should type-assert for this interface and call EnsureChains
+// once during sync, before wiring the detector's rules into their own chains.
+type ChainInstallingLocalTrafficDetector interface {
+	LocalTrafficDetector
+
+	// EnsureChains installs whatever helper chains and rules this detector depends on, and
+	// hooks them into hookChain (in hookTable) so traffic actually reaches them.
+	EnsureChains(ipt IPTablesEnsurer, hookTable, hookChain string) error
+}
+
+// compositeLocalTrafficChain is the internal chain NewCompositeLocalDetector's EnsureChains
+// installs to OR its constituents together.
+const compositeLocalTrafficChain = "KUBE-MARK-LOCAL-TRAFFIC"
+
+type compositeLocalDetector struct {
+	detectors []LocalTrafficDetector
+	// mark is the bare hex mark bit (e.g. "0x00002000") packets matching any constituent are
+	// tagged with. It is caller-supplied so it can be allocated alongside the caller's other
+	// marks (e.g. the masquerade mark) without colliding with them.
+	mark string
+}
+
+// NewCompositeLocalDetector ORs together the IfLocal (and ANDs the IfNotLocal) results of
+// multiple LocalTrafficDetector strategies, for hybrid clusters that need more than one mode
+// at once (for example hostNetwork pods behind a bridge interface plus overlay pods in a
+// CIDR). Neither iptables nor nftables can OR unrelated match types (e.g. -s and -i) within
+// a single rule, so both backends use the same trick: every constituent gets its own rule
+// marking matching packets with mark, and IfLocal/IfNotLocal/IfLocalNFT/IfNotLocalNFT just
+// test that mark. mark must be a bit not already used by the caller for anything else (for
+// example, it must not collide with a masquerade or drop mark).
+//
+// The returned detector also implements ChainInstallingLocalTrafficDetector: its EnsureChains
+// installs compositeLocalTrafficChain with the per-constituent iptables MARK rules, and hooks
+// it into the caller's own chain so traffic actually passes through it. There is no iptables
+// equivalent for nft backends; nft callers should use Constituents and NFTSetMarkStatement to
+// install the same per-constituent marking rules into their own chain.
+func NewCompositeLocalDetector(mark string, detectors ...LocalTrafficDetector) (LocalTrafficDetector, error) {
+	if len(mark) == 0 {
+		return nil, fmt.Errorf("mark must be a non-empty hex mark bit (e.g. \"0x00002000\") not already used for another purpose, such as masquerading or dropping packets")
+	}
+
+	implemented := make([]LocalTrafficDetector, 0, len(detectors))
+	for _, d := range detectors {
+		if d != nil && d.IsImplemented() {
+			implemented = append(implemented, d)
+		}
+	}
+
+	return &compositeLocalDetector{
+		detectors: implemented,
+		mark:      mark,
+	}, nil
+}
+
+// xmark is the iptables value/mask form of mark, for use with --mark and --set-xmark.
+func (d *compositeLocalDetector) xmark() string {
+	return d.mark + "/" + d.mark
+}
+
+func (d *compositeLocalDetector) IsImplemented() bool {
+	return len(d.detectors) > 0
+}
+
+func (d *compositeLocalDetector) IfLocal() []string {
+	return []string{"-m", "mark", "--mark", d.xmark()}
+}
+
+func (d *compositeLocalDetector) IfNotLocal() []string {
+	return []string{"-m", "mark", "!", "--mark", d.xmark()}
+}
+
+func (d *compositeLocalDetector) IfLocalNFT() []string {
+	return []string{"meta", "mark", "and", d.mark, "==", d.mark}
+}
+
+func (d *compositeLocalDetector) IfNotLocalNFT() []string {
+	return []string{"meta", "mark", "and", d.mark, "!=", d.mark}
+}
+
+// Constituents returns the detectors this composite combines, so a caller driving nft rules
+// directly (which has no EnsureChains-style hook in this package) can install the
+// per-constituent marking rules itself: one rule per constituent, matching that constituent's
+// IfLocalNFT() and carrying out NFTSetMarkStatement().
+func (d *compositeLocalDetector) Constituents() []LocalTrafficDetector {
+	return d.detectors
+}
+
+// NFTSetMarkStatement returns the nft statement that tags a packet matching a constituent's
+// IfLocalNFT() condition with mark, without disturbing any other mark bits already set.
+func (d *compositeLocalDetector) NFTSetMarkStatement() []string {
+	return []string{"meta", "mark", "set", "mark", "or", d.mark}
+}
+
+// EnsureChains installs compositeLocalTrafficChain in hookTable with one rule per constituent
+// detector marking packets matching that detector's IfLocal() with mark, and then ensures a
+// rule in hookChain (also in hookTable) unconditionally jumps to compositeLocalTrafficChain,
+// so that every packet is actually run through it before IfLocal/IfNotLocal's mark match is
+// evaluated downstream. The chain and the jump must live in the same table — iptables can't
+// jump across tables — so both are installed into hookTable (the same way KUBE-MARK-MASQ
+// lives in whichever table the rule that jumps to it does); mark-setting itself works in any
+// table, not just mangle. Without the jump rule, nothing would ever reach
+// compositeLocalTrafficChain and the mark would never be set.
+func (d *compositeLocalDetector) EnsureChains(ipt IPTablesEnsurer, hookTable, hookChain string) error {
+	if _, err := ipt.EnsureChain(hookTable, compositeLocalTrafficChain); err != nil {
+		return err
+	}
+	for _, constituent := range d.detectors {
+		args := append(append([]string{}, constituent.IfLocal()...), "-j", "MARK", "--set-xmark", d.xmark())
+		if _, err := ipt.EnsureRule(Append, hookTable, compositeLocalTrafficChain, args...); err != nil {
+			return err
+		}
+	}
+	if _, err := ipt.EnsureRule(Prepend, hookTable, hookChain, "-j", compositeLocalTrafficChain); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SocketOwnerMode selects how NewDetectLocalBySocketOwner identifies a packet as
+// originating from a local socket.
+type SocketOwnerMode string
+
+const (
+	// SocketExists matches any packet for which the kernel can find an owning local socket.
+	// Its nftables form (`socket wildcard 0`) matches only sockets that are not bound to a
+	// wildcard address.
+	SocketExists SocketOwnerMode = "SocketExists"
+	// TransparentOnly matches only sockets set up for transparent proxying (IP_TRANSPARENT).
+	TransparentOnly SocketOwnerMode = "TransparentOnly"
+	// OwnerUID matches sockets owned by one of a configured list of UIDs.
+	OwnerUID SocketOwnerMode = "OwnerUID"
+)
+
+type detectLocalBySocketOwner struct {
+	ifLocal       []string
+	ifNotLocal    []string
+	ifLocalNFT    []string
+	ifNotLocalNFT []string
+}
+
+// NewDetectLocalBySocketOwner implements the LocalTrafficDetector interface by matching on
+// the local socket that owns a packet rather than its source address, using the xt_socket/
+// xt_owner and nft `socket`/`meta skuid` matchers. This distinguishes local pod traffic even
+// when hostNetwork pods and node daemons share the node's IP, which address- or
+// interface-based detectors can't do. uids is only consulted when mode is OwnerUID. It probes
+// execer at construction time to confirm the running iptables was built with the match
+// extension mode depends on (socket for SocketExists/TransparentOnly, owner for OwnerUID),
+// returning an error so the caller can fall back to NewNoOpLocalDetector if it wasn't.
+func NewDetectLocalBySocketOwner(execer utilexec.Interface, mode SocketOwnerMode, uids []string) (LocalTrafficDetector, error) {
+	d := &detectLocalBySocketOwner{}
+	switch mode {
+	case SocketExists:
+		if err := probeIPTablesMatchSupported(execer, "socket"); err != nil {
+			return nil, err
+		}
+		d.ifLocal = []string{"-m", "socket", "--nowildcard"}
+		d.ifNotLocal = []string{"-m", "socket", "!", "--nowildcard"}
+		d.ifLocalNFT = []string{"socket", "wildcard", "0"}
+		d.ifNotLocalNFT = []string{"socket", "wildcard", "!=", "0"}
+	case TransparentOnly:
+		if err := probeIPTablesMatchSupported(execer, "socket"); err != nil {
+			return nil, err
+		}
+		d.ifLocal = []string{"-m", "socket", "--transparent"}
+		d.ifNotLocal = []string{"-m", "socket", "!", "--transparent"}
+		d.ifLocalNFT = []string{"socket", "transparent", "1"}
+		d.ifNotLocalNFT = []string{"socket", "transparent", "!=", "1"}
+	case OwnerUID:
+		if err := probeIPTablesMatchSupported(execer, "owner"); err != nil {
+			return nil, err
+		}
+		if len(uids) == 0 {
+			return nil, fmt.Errorf("OwnerUID mode requires at least one uid")
+		}
+		uidList := strings.Join(uids, ",")
+		d.ifLocal = []string{"-m", "owner", "--uid-owner", uidList}
+		d.ifNotLocal = []string{"-m", "owner", "!", "--uid-owner", uidList}
+		d.ifLocalNFT = []string{"meta", "skuid", "{", uidList, "}"}
+		d.ifNotLocalNFT = []string{"meta", "skuid", "!=", "{", uidList, "}"}
+	default:
+		return nil, fmt.Errorf("unknown socket owner mode %q", mode)
+	}
+	return d, nil
+}
+
+func (d *detectLocalBySocketOwner) IsImplemented() bool {
+	return true
+}
+
+func (d *detectLocalBySocketOwner) IfLocal() []string {
+	return d.ifLocal
+}
+
+func (d *detectLocalBySocketOwner) IfNotLocal() []string {
+	return d.ifNotLocal
+}
+
+func (d *detectLocalBySocketOwner) IfLocalNFT() []string {
+	return d.ifLocalNFT
+}
+
+func (d *detectLocalBySocketOwner) IfNotLocalNFT() []string {
+	return d.ifNotLocalNFT
+}
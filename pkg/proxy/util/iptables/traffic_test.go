@@ -0,0 +1,476 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	utilexec "k8s.io/utils/exec"
+)
+
+// fakeCmd is a minimal utilexec.Cmd that only implements CombinedOutput (and capturing
+// stdin), which is all the probes in this package use.
+type fakeCmd struct {
+	out    []byte
+	err    error
+	stdin  io.Reader
+	onStop func(stdin []byte)
+}
+
+func (c *fakeCmd) Run() error { _, err := c.CombinedOutput(); return err }
+func (c *fakeCmd) CombinedOutput() ([]byte, error) {
+	if c.onStop != nil {
+		var stdin []byte
+		if c.stdin != nil {
+			stdin, _ = io.ReadAll(c.stdin)
+		}
+		c.onStop(stdin)
+	}
+	return c.out, c.err
+}
+func (c *fakeCmd) Output() ([]byte, error)            { return c.CombinedOutput() }
+func (c *fakeCmd) SetDir(dir string)                  {}
+func (c *fakeCmd) SetStdin(in io.Reader)              { c.stdin = in }
+func (c *fakeCmd) SetStdout(out io.Writer)            {}
+func (c *fakeCmd) SetStderr(out io.Writer)            {}
+func (c *fakeCmd) SetEnv(env []string)                {}
+func (c *fakeCmd) StdoutPipe() (io.ReadCloser, error) { return nil, nil }
+func (c *fakeCmd) StderrPipe() (io.ReadCloser, error) { return nil, nil }
+func (c *fakeCmd) Start() error                       { return c.err }
+func (c *fakeCmd) Wait() error                        { return c.err }
+func (c *fakeCmd) Stop()                              {}
+
+// fakeExec is a minimal utilexec.Interface that returns a canned result for every command,
+// and records the commands (and any stdin fed to them) it was asked to run.
+type fakeExec struct {
+	out    []byte
+	err    error
+	runs   [][]string
+	stdins [][]byte
+}
+
+func (f *fakeExec) Command(cmd string, args ...string) utilexec.Cmd {
+	f.runs = append(f.runs, append([]string{cmd}, args...))
+	return &fakeCmd{out: f.out, err: f.err, onStop: func(stdin []byte) {
+		f.stdins = append(f.stdins, stdin)
+	}}
+}
+
+func (f *fakeExec) CommandContext(_ context.Context, cmd string, args ...string) utilexec.Cmd {
+	return f.Command(cmd, args...)
+}
+
+func (f *fakeExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+var errProbeFailed = fmt.Errorf("probe failed")
+
+func TestNewDetectLocalByCIDRs(t *testing.T) {
+	cases := []struct {
+		name          string
+		cidrs         []string
+		wantErr       bool
+		wantNFTFamily string
+	}{
+		{
+			name:          "single IPv4 CIDR",
+			cidrs:         []string{"10.0.0.0/8"},
+			wantNFTFamily: "ip",
+		},
+		{
+			name:          "multiple IPv4 CIDRs",
+			cidrs:         []string{"10.0.0.0/8", "172.16.0.0/12"},
+			wantNFTFamily: "ip",
+		},
+		{
+			name:          "multiple IPv6 CIDRs",
+			cidrs:         []string{"fd00:1::/64", "fd00:2::/64"},
+			wantNFTFamily: "ip6",
+		},
+		{
+			name:    "mixed families rejected",
+			cidrs:   []string{"10.0.0.0/8", "fd00:1::/64"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid CIDR",
+			cidrs:   []string{"not-a-cidr"},
+			wantErr: true,
+		},
+		{
+			name:    "empty list",
+			cidrs:   nil,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := NewDetectLocalByCIDRs(tc.cidrs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got detector %#v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			cidrDetector, ok := d.(*detectLocalByCIDRs)
+			if !ok {
+				t.Fatalf("expected *detectLocalByCIDRs, got %T", d)
+			}
+
+			if got := cidrDetector.IfLocal(); !reflect.DeepEqual(got, []string{"-m", "set", "--match-set", cidrDetector.SetName(), "src"}) {
+				t.Errorf("IfLocal() = %v", got)
+			}
+			if got := cidrDetector.IfNotLocal(); !reflect.DeepEqual(got, []string{"-m", "set", "!", "--match-set", cidrDetector.SetName(), "src"}) {
+				t.Errorf("IfNotLocal() = %v", got)
+			}
+			if got := cidrDetector.IfLocalNFT(); !reflect.DeepEqual(got, []string{tc.wantNFTFamily, "saddr", "@" + cidrDetector.NFTSetName()}) {
+				t.Errorf("IfLocalNFT() = %v", got)
+			}
+			if got := cidrDetector.IfNotLocalNFT(); !reflect.DeepEqual(got, []string{tc.wantNFTFamily, "saddr", "!=", "@" + cidrDetector.NFTSetName()}) {
+				t.Errorf("IfNotLocalNFT() = %v", got)
+			}
+			if !reflect.DeepEqual(cidrDetector.CIDRs(), tc.cidrs) {
+				t.Errorf("CIDRs() = %v, want %v", cidrDetector.CIDRs(), tc.cidrs)
+			}
+		})
+	}
+}
+
+func TestNewDetectLocalByCIDRsDualStack(t *testing.T) {
+	detectors, err := NewDetectLocalByCIDRsDualStack([]string{"10.0.0.0/8", "fd00:1::/64", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(detectors) != 2 {
+		t.Fatalf("expected 2 detectors, got %d", len(detectors))
+	}
+
+	v4, ok := detectors[IPv4].(*detectLocalByCIDRs)
+	if !ok {
+		t.Fatalf("expected IPv4 detector to be present")
+	}
+	if !reflect.DeepEqual(v4.CIDRs(), []string{"10.0.0.0/8", "172.16.0.0/12"}) {
+		t.Errorf("IPv4 CIDRs() = %v", v4.CIDRs())
+	}
+
+	v6, ok := detectors[IPv6].(*detectLocalByCIDRs)
+	if !ok {
+		t.Fatalf("expected IPv6 detector to be present")
+	}
+	if !reflect.DeepEqual(v6.CIDRs(), []string{"fd00:1::/64"}) {
+		t.Errorf("IPv6 CIDRs() = %v", v6.CIDRs())
+	}
+}
+
+type fakeSetEnsurer struct {
+	calls map[string][]string
+}
+
+func (f *fakeSetEnsurer) EnsureSet(name string, _ IPFamily, members []string) error {
+	if f.calls == nil {
+		f.calls = map[string][]string{}
+	}
+	f.calls[name] = members
+	return nil
+}
+
+func TestDetectLocalByCIDRsEnsureSet(t *testing.T) {
+	d, err := NewDetectLocalByCIDRs([]string{"10.0.0.0/8", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	setInstaller, ok := d.(SetInstallingLocalTrafficDetector)
+	if !ok {
+		t.Fatalf("expected detector to implement SetInstallingLocalTrafficDetector")
+	}
+
+	ensurer := &fakeSetEnsurer{}
+	if err := setInstaller.EnsureSet(ensurer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cidrDetector := d.(*detectLocalByCIDRs)
+	want := map[string][]string{
+		cidrDetector.SetName():    cidrDetector.CIDRs(),
+		cidrDetector.NFTSetName(): cidrDetector.CIDRs(),
+	}
+	if !reflect.DeepEqual(ensurer.calls, want) {
+		t.Errorf("EnsureSet calls = %v, want %v", ensurer.calls, want)
+	}
+}
+
+func TestNewDetectLocalByKernelRouting(t *testing.T) {
+	cases := []struct {
+		name    string
+		backend Backend
+		execErr error
+		wantErr bool
+	}{
+		{name: "iptables backend, supported", backend: IPTablesBackend},
+		{name: "iptables backend, unsupported", backend: IPTablesBackend, execErr: errProbeFailed, wantErr: true},
+		{name: "nftables backend, supported", backend: NFTablesBackend},
+		{name: "nftables backend, unsupported", backend: NFTablesBackend, execErr: errProbeFailed, wantErr: true},
+		{name: "unknown backend", backend: "bogus", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			execer := &fakeExec{err: tc.execErr}
+			d, err := NewDetectLocalByKernelRouting(execer, tc.backend)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got detector %#v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(execer.runs) != 1 {
+				t.Fatalf("expected exactly one probe command for a single-backend constructor, got %v", execer.runs)
+			}
+			if tc.backend == NFTablesBackend {
+				for _, arg := range execer.runs[0] {
+					if arg == "INPUT" {
+						t.Fatalf("nft probe must not reference a pre-existing chain, got %v", execer.runs[0])
+					}
+				}
+				if len(execer.stdins) != 1 || string(execer.stdins[0]) != probeNFTRuleset {
+					t.Fatalf("expected the nft probe to validate its own self-contained ruleset, got stdin %v", execer.stdins)
+				}
+			}
+		})
+	}
+}
+
+func TestNewCompositeLocalDetector(t *testing.T) {
+	if _, err := NewCompositeLocalDetector(""); err == nil {
+		t.Fatalf("expected error for empty mark")
+	}
+
+	bridge, err := NewDetectLocalByBridgeInterface("cbr0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cidr, err := NewDetectLocalByCIDR("10.244.0.0/16")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d, err := NewCompositeLocalDetector("0x00002000", bridge, cidr, NewNoOpLocalDetector())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := d.IfLocal(), []string{"-m", "mark", "--mark", "0x00002000/0x00002000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IfLocal() = %v, want %v", got, want)
+	}
+	if got, want := d.IfNotLocal(), []string{"-m", "mark", "!", "--mark", "0x00002000/0x00002000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IfNotLocal() = %v, want %v", got, want)
+	}
+	if got, want := d.IfLocalNFT(), []string{"meta", "mark", "and", "0x00002000", "==", "0x00002000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IfLocalNFT() = %v, want %v", got, want)
+	}
+	if got, want := d.IfNotLocalNFT(), []string{"meta", "mark", "and", "0x00002000", "!=", "0x00002000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IfNotLocalNFT() = %v, want %v", got, want)
+	}
+
+	composite, ok := d.(*compositeLocalDetector)
+	if !ok {
+		t.Fatalf("expected *compositeLocalDetector, got %T", d)
+	}
+	if len(composite.Constituents()) != 2 {
+		t.Fatalf("expected the no-op detector to be filtered out, got %d constituents", len(composite.Constituents()))
+	}
+	if got, want := composite.NFTSetMarkStatement(), []string{"meta", "mark", "set", "mark", "or", "0x00002000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NFTSetMarkStatement() = %v, want %v", got, want)
+	}
+}
+
+// fakeIPTablesEnsurer is table-scoped like real iptables: a jump ("-j TARGET") is only valid
+// if TARGET was created (via EnsureChain) in the same table as the rule doing the jumping,
+// so this fake catches the cross-table jump bug a looser fake wouldn't.
+type fakeIPTablesEnsurer struct {
+	chains map[string]bool // "table/chain" -> exists
+	rules  [][]string
+}
+
+func (f *fakeIPTablesEnsurer) EnsureChain(table, chain string) (bool, error) {
+	if f.chains == nil {
+		f.chains = map[string]bool{}
+	}
+	f.chains[table+"/"+chain] = true
+	return false, nil
+}
+
+func (f *fakeIPTablesEnsurer) EnsureRule(position RulePosition, table, chain string, args ...string) (bool, error) {
+	for i, arg := range args {
+		if arg == "-j" && i+1 < len(args) {
+			target := args[i+1]
+			if target != "MARK" && target != "RETURN" && target != "ACCEPT" && target != "DROP" {
+				if !f.chains[table+"/"+target] {
+					return false, fmt.Errorf("rule in %s/%s jumps to %q, which was never created in table %q", table, chain, target, table)
+				}
+			}
+		}
+	}
+	f.rules = append(f.rules, append([]string{string(position), table, chain}, args...))
+	return false, nil
+}
+
+func TestCompositeLocalDetectorEnsureChains(t *testing.T) {
+	bridge, err := NewDetectLocalByBridgeInterface("cbr0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cidr, err := NewDetectLocalByCIDR("10.244.0.0/16")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d, err := NewCompositeLocalDetector("0x00002000", bridge, cidr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	installer, ok := d.(ChainInstallingLocalTrafficDetector)
+	if !ok {
+		t.Fatalf("expected detector to implement ChainInstallingLocalTrafficDetector")
+	}
+
+	ensurer := &fakeIPTablesEnsurer{}
+	if err := installer.EnsureChains(ensurer, "nat", "KUBE-SERVICES"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := map[string]bool{"nat/" + compositeLocalTrafficChain: true}; !reflect.DeepEqual(ensurer.chains, want) {
+		t.Errorf("chains created = %v, want %v", ensurer.chains, want)
+	}
+
+	wantRules := [][]string{
+		append([]string{"append", "nat", compositeLocalTrafficChain}, append(bridge.IfLocal(), "-j", "MARK", "--set-xmark", "0x00002000/0x00002000")...),
+		append([]string{"append", "nat", compositeLocalTrafficChain}, append(cidr.IfLocal(), "-j", "MARK", "--set-xmark", "0x00002000/0x00002000")...),
+		{"prepend", "nat", "KUBE-SERVICES", "-j", compositeLocalTrafficChain},
+	}
+	if !reflect.DeepEqual(ensurer.rules, wantRules) {
+		t.Errorf("rules installed = %v, want %v", ensurer.rules, wantRules)
+	}
+}
+
+func TestNewDetectLocalBySocketOwner(t *testing.T) {
+	cases := []struct {
+		name           string
+		mode           SocketOwnerMode
+		uids           []string
+		wantErr        bool
+		wantProbeMatch string
+		wantIfLocal    []string
+		wantIfNotLocal []string
+		wantNFT        []string
+		wantNotNFT     []string
+	}{
+		{
+			name:           "socket exists",
+			mode:           SocketExists,
+			wantProbeMatch: "socket",
+			wantIfLocal:    []string{"-m", "socket", "--nowildcard"},
+			wantIfNotLocal: []string{"-m", "socket", "!", "--nowildcard"},
+			wantNFT:        []string{"socket", "wildcard", "0"},
+			wantNotNFT:     []string{"socket", "wildcard", "!=", "0"},
+		},
+		{
+			name:           "transparent only",
+			mode:           TransparentOnly,
+			wantProbeMatch: "socket",
+			wantIfLocal:    []string{"-m", "socket", "--transparent"},
+			wantIfNotLocal: []string{"-m", "socket", "!", "--transparent"},
+			wantNFT:        []string{"socket", "transparent", "1"},
+			wantNotNFT:     []string{"socket", "transparent", "!=", "1"},
+		},
+		{
+			name:           "owner uid",
+			mode:           OwnerUID,
+			uids:           []string{"1000", "2000"},
+			wantProbeMatch: "owner",
+			wantIfLocal:    []string{"-m", "owner", "--uid-owner", "1000,2000"},
+			wantIfNotLocal: []string{"-m", "owner", "!", "--uid-owner", "1000,2000"},
+			wantNFT:        []string{"meta", "skuid", "{", "1000,2000", "}"},
+			wantNotNFT:     []string{"meta", "skuid", "!=", "{", "1000,2000", "}"},
+		},
+		{
+			name:    "owner uid without uids",
+			mode:    OwnerUID,
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			mode:    "bogus",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			execer := &fakeExec{}
+			d, err := NewDetectLocalBySocketOwner(execer, tc.mode, tc.uids)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got detector %#v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(execer.runs) != 1 || len(execer.runs[0]) < 2 || execer.runs[0][1] != "-m" || execer.runs[0][2] != tc.wantProbeMatch {
+				t.Fatalf("expected a probe of the %q match, got %v", tc.wantProbeMatch, execer.runs)
+			}
+			if got := d.IfLocal(); !reflect.DeepEqual(got, tc.wantIfLocal) {
+				t.Errorf("IfLocal() = %v, want %v", got, tc.wantIfLocal)
+			}
+			if got := d.IfNotLocal(); !reflect.DeepEqual(got, tc.wantIfNotLocal) {
+				t.Errorf("IfNotLocal() = %v, want %v", got, tc.wantIfNotLocal)
+			}
+			if got := d.IfLocalNFT(); !reflect.DeepEqual(got, tc.wantNFT) {
+				t.Errorf("IfLocalNFT() = %v, want %v", got, tc.wantNFT)
+			}
+			if got := d.IfNotLocalNFT(); !reflect.DeepEqual(got, tc.wantNotNFT) {
+				t.Errorf("IfNotLocalNFT() = %v, want %v", got, tc.wantNotNFT)
+			}
+		})
+	}
+}
+
+func TestNewDetectLocalBySocketOwnerProbeFailure(t *testing.T) {
+	execer := &fakeExec{err: errProbeFailed}
+	if _, err := NewDetectLocalBySocketOwner(execer, SocketExists, nil); err == nil {
+		t.Fatalf("expected error when the socket match isn't supported")
+	}
+	if _, err := NewDetectLocalBySocketOwner(execer, OwnerUID, []string{"1000"}); err == nil {
+		t.Fatalf("expected error when the owner match isn't supported")
+	}
+}